@@ -0,0 +1,43 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Strategy computes how long runClient should wait before its retries-th
+// reconnect attempt (0-indexed).
+type Strategy interface {
+	Backoff(retries int) time.Duration
+}
+
+// ExponentialBackoff is the default Strategy: baseDelay * multiplier^retries
+// capped at maxDelay, with uniform jitter of ±20% so many clients
+// restarted together don't all reconnect in lockstep.
+type ExponentialBackoff struct {
+	BaseDelay  time.Duration
+	Multiplier float64
+	MaxDelay   time.Duration
+}
+
+// Backoff implements Strategy.
+func (b ExponentialBackoff) Backoff(retries int) time.Duration {
+	delay := float64(b.BaseDelay) * math.Pow(b.Multiplier, float64(retries))
+	if max := float64(b.MaxDelay); delay > max {
+		delay = max
+	}
+	jitter := delay * 0.2
+	delay += (rand.Float64()*2 - 1) * jitter
+	if delay < 0 {
+		delay = 0
+	} else if max := float64(b.MaxDelay); delay > max {
+		delay = max
+	}
+	return time.Duration(delay)
+}
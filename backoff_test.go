@@ -0,0 +1,64 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoffBounds(t *testing.T) {
+	b := ExponentialBackoff{
+		BaseDelay:  time.Second,
+		Multiplier: 1.6,
+		MaxDelay:   30 * time.Second,
+	}
+
+	cases := []struct {
+		retries  int
+		wantBase time.Duration // the pre-jitter delay this retries count should produce
+	}{
+		{retries: 0, wantBase: time.Second},
+		{retries: 1, wantBase: 1600 * time.Millisecond},
+		{retries: 2, wantBase: 2560 * time.Millisecond},
+		{retries: 20, wantBase: 30 * time.Second}, // multiplier^20 blows past MaxDelay
+	}
+
+	for _, c := range cases {
+		// ±20% jitter is applied after the cap, so the result can land up
+		// to 20% beyond MaxDelay itself.
+		lo := float64(c.wantBase) * 0.8
+		hi := float64(c.wantBase) * 1.2
+		if hi > float64(b.MaxDelay) {
+			hi = float64(b.MaxDelay) // the post-jitter result is reclamped to MaxDelay
+		}
+		for i := 0; i < 50; i++ {
+			got := b.Backoff(c.retries)
+			if got < 0 {
+				t.Fatalf("retries=%d: Backoff returned negative delay %v", c.retries, got)
+			}
+			if got > b.MaxDelay {
+				t.Fatalf("retries=%d: Backoff returned %v, exceeds MaxDelay %v", c.retries, got, b.MaxDelay)
+			}
+			if float64(got) < lo || float64(got) > hi {
+				t.Fatalf("retries=%d: Backoff returned %v, want within [%v, %v]", c.retries, got, time.Duration(lo), time.Duration(hi))
+			}
+		}
+	}
+}
+
+func TestExponentialBackoffNeverNegative(t *testing.T) {
+	b := ExponentialBackoff{
+		BaseDelay:  time.Millisecond,
+		Multiplier: 1.6,
+		MaxDelay:   time.Second,
+	}
+	for i := 0; i < 200; i++ {
+		if d := b.Backoff(0); d < 0 {
+			t.Fatalf("Backoff(0) returned negative delay %v", d)
+		}
+	}
+}
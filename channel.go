@@ -0,0 +1,129 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hanyangzhao/golemu/internal/binlog"
+)
+
+// Message is one parsed LLRP frame: its header fields plus the payload
+// bytes that follow the 10-byte header (2-byte type + 4-byte length +
+// 4-byte messageID).
+type Message struct {
+	Type    uint16
+	ID      uint32
+	Payload []byte
+}
+
+// Channel frames LLRP messages over a net.Conn. Unlike a single fixed-size
+// conn.Read, it parses the 10-byte header and then reads exactly
+// length-10 payload bytes with io.ReadFull, so a message fragmented
+// across TCP reads (or longer than the old BufferSize) is reassembled
+// correctly instead of desyncing the stream.
+type Channel struct {
+	conn   net.Conn
+	binlog *binlog.Writer
+}
+
+// NewChannel wraps conn for framed LLRP reads and writes. If binlogWriter
+// is set (via --binlog), every frame read or written through the Channel
+// is also recorded to it.
+func NewChannel(conn net.Conn) *Channel {
+	return &Channel{conn: conn, binlog: binlogWriter}
+}
+
+// unblockOnDone forces conn's in-flight Read/Write to return early if ctx
+// is canceled before the returned stop func is called, since net.Conn has
+// no native context support.
+func unblockOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// ctxErr reports ctx.Err() instead of err when ctx is why the operation
+// failed, so callers can tell a cancellation from a genuine I/O error.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// maxMessageLength caps the length field of an incoming LLRP frame. It's
+// far above any message this emulator or a real reader would send, and
+// exists only so a bogus or malicious length field can't make ReadMessage
+// allocate an unbounded payload buffer.
+const maxMessageLength = 64 * 1024 * 1024
+
+// ReadMessage blocks until a full LLRP frame arrives, ctx is canceled, or
+// the connection errors.
+func (c *Channel) ReadMessage(ctx context.Context) (*Message, error) {
+	stop := unblockOnDone(ctx, c.conn)
+	defer stop()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	msgType := binary.BigEndian.Uint16(header[0:2])
+	length := binary.BigEndian.Uint32(header[2:6])
+	id := binary.BigEndian.Uint32(header[6:10])
+	if length < 10 {
+		return nil, fmt.Errorf("llrp: message length %d shorter than the 10-byte header", length)
+	}
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("llrp: message length %d exceeds %d-byte limit", length, maxMessageLength)
+	}
+
+	payload := make([]byte, length-10)
+	if len(payload) > 0 {
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+	}
+
+	if c.binlog != nil {
+		frame := append(append([]byte{}, header...), payload...)
+		if err := c.binlog.Record(binlog.Received, c.conn.RemoteAddr().String(), msgType, frame); err != nil {
+			l.Warnln("binlog: failed to record received frame:", err)
+		}
+	}
+
+	return &Message{Type: msgType, ID: id, Payload: payload}, nil
+}
+
+// WriteMessage sends data, which must already be a fully-framed LLRP
+// message (as produced by the llrp package's builders or this package's
+// own roSpecStatusResponse/llrpStatus helpers).
+func (c *Channel) WriteMessage(ctx context.Context, data []byte) error {
+	stop := unblockOnDone(ctx, c.conn)
+	defer stop()
+	if _, err := c.conn.Write(data); err != nil {
+		return ctxErr(ctx, err)
+	}
+	if c.binlog != nil && len(data) >= 2 {
+		msgType := binary.BigEndian.Uint16(data[0:2])
+		if err := c.binlog.Record(binlog.Sent, c.conn.RemoteAddr().String(), msgType, data); err != nil {
+			l.Warnln("binlog: failed to record sent frame:", err)
+		}
+	}
+	return nil
+}
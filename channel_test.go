@@ -0,0 +1,120 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// frame builds a raw LLRP frame: 2-byte type, 4-byte length (header
+// included), 4-byte messageID, then payload.
+func frame(msgType uint16, id uint32, payload []byte) []byte {
+	buf := make([]byte, 10+len(payload))
+	binary.BigEndian.PutUint16(buf[0:2], msgType)
+	binary.BigEndian.PutUint32(buf[2:6], uint32(len(buf)))
+	binary.BigEndian.PutUint32(buf[6:10], id)
+	copy(buf[10:], payload)
+	return buf
+}
+
+func TestChannelReadMessageReassemblesSplitWrites(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	f := frame(1027, 42, []byte{1, 2, 3, 4, 5})
+	go func() {
+		// Write the frame split across three separate Writes so
+		// ReadMessage has to reassemble it via io.ReadFull rather than a
+		// single conn.Read.
+		client.Write(f[:3])
+		client.Write(f[3:7])
+		client.Write(f[7:])
+	}()
+
+	ch := NewChannel(server)
+	msg, err := ch.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if msg.Type != 1027 || msg.ID != 42 {
+		t.Fatalf("ReadMessage = {Type: %v, ID: %v}, want {1027, 42}", msg.Type, msg.ID)
+	}
+	if string(msg.Payload) != string([]byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("ReadMessage payload = %v, want [1 2 3 4 5]", msg.Payload)
+	}
+}
+
+func TestChannelReadMessageRejectsShortLength(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	header := make([]byte, 10)
+	binary.BigEndian.PutUint16(header[0:2], 1027)
+	binary.BigEndian.PutUint32(header[2:6], 9) // shorter than the 10-byte header itself
+	go client.Write(header)
+
+	ch := NewChannel(server)
+	if _, err := ch.ReadMessage(context.Background()); err == nil {
+		t.Fatal("ReadMessage with length < 10: got nil error, want one")
+	}
+}
+
+func TestChannelReadMessageRejectsOversizedLength(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	header := make([]byte, 10)
+	binary.BigEndian.PutUint16(header[0:2], 1027)
+	binary.BigEndian.PutUint32(header[2:6], maxMessageLength+1)
+	go client.Write(header)
+
+	ch := NewChannel(server)
+	if _, err := ch.ReadMessage(context.Background()); err == nil {
+		t.Fatal("ReadMessage with length > maxMessageLength: got nil error, want one")
+	}
+}
+
+func TestChannelWriteMessageWritesRawFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	f := frame(1037, 7, []byte{0xde, 0xad})
+	errCh := make(chan error, 1)
+	go func() {
+		ch := NewChannel(server)
+		errCh <- ch.WriteMessage(context.Background(), f)
+	}()
+
+	got := make([]byte, len(f))
+	if _, err := readFull(client, got); err != nil {
+		t.Fatalf("reading what WriteMessage sent: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if string(got) != string(f) {
+		t.Fatalf("WriteMessage wrote %x, want %x", got, f)
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
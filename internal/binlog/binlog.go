@@ -0,0 +1,214 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+// Package binlog records and replays the raw LLRP frames golemu sends and
+// receives, so a capture of real reader traffic can later drive downstream
+// systems deterministically against golemu.
+//
+// Each record is a fixed header followed by the captured frame bytes:
+//
+//	int64   timestamp  nanoseconds elapsed since the log was opened
+//	uint8   direction  0 = Sent, 1 = Received
+//	uint16  addrLen    length of the peer address that follows
+//	[]byte  addr       the peer address, addrLen bytes
+//	uint32  frameLen   length of the frame that follows
+//	[]byte  frame      the raw LLRP bytes (header+payload), possibly
+//	                   truncated to just the 10-byte header by a Filter
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction records which way a frame crossed the wire relative to the
+// process that captured it.
+type Direction uint8
+
+const (
+	Sent Direction = iota
+	Received
+)
+
+func (d Direction) String() string {
+	if d == Received {
+		return "received"
+	}
+	return "sent"
+}
+
+// Mode controls how much of a frame Writer.Record keeps.
+type Mode uint8
+
+const (
+	// ModeFull keeps the entire frame.
+	ModeFull Mode = iota
+	// ModeHeader truncates the frame to its 10-byte LLRP header, dropping
+	// the payload.
+	ModeHeader
+)
+
+// Filter maps an LLRP message type to the Mode its frames should be
+// recorded with. A type absent from the Filter is recorded with ModeFull.
+type Filter map[uint16]Mode
+
+// ParseFilter parses a --binlogFilter value such as
+// "ROAccessReport=header,SetReaderConfig=full" into a Filter. names
+// resolves each message type name to its wire header value; it's supplied
+// by the caller since this package doesn't know the LLRP message set.
+func ParseFilter(spec string, names map[string]uint16) (Filter, error) {
+	filter := Filter{}
+	if strings.TrimSpace(spec) == "" {
+		return filter, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("binlog: invalid filter entry %q, want Name=mode", entry)
+		}
+		name, modeStr := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		msgType, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("binlog: unknown message type %q in filter", name)
+		}
+		switch strings.ToLower(modeStr) {
+		case "full":
+			filter[msgType] = ModeFull
+		case "header":
+			filter[msgType] = ModeHeader
+		default:
+			return nil, fmt.Errorf("binlog: unknown filter mode %q for %q, want full or header", modeStr, name)
+		}
+	}
+	return filter, nil
+}
+
+// ModeFor reports the Mode msgType should be recorded with.
+func (f Filter) ModeFor(msgType uint16) Mode {
+	return f[msgType]
+}
+
+// Record is one captured frame as read back by a Reader.
+type Record struct {
+	// Timestamp is how long after the log was opened this frame was
+	// captured, used by replay to reproduce the original pacing.
+	Timestamp time.Duration
+	Direction Direction
+	PeerAddr  string
+	// Frame is the raw LLRP bytes captured for this record: the 10-byte
+	// header plus payload, or just the header if a Filter truncated it.
+	Frame []byte
+}
+
+// Writer appends captured frames to an underlying io.Writer.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	start  time.Time
+	filter Filter
+}
+
+// NewWriter returns a Writer that records frames to w, truncating them
+// per filter (a nil or empty Filter records every frame in full). If w
+// also implements io.Closer, Close closes it.
+func NewWriter(w io.Writer, filter Filter) *Writer {
+	writer := &Writer{w: w, start: time.Now(), filter: filter}
+	if c, ok := w.(io.Closer); ok {
+		writer.closer = c
+	}
+	return writer
+}
+
+// Record appends one captured frame. msgType is used only to look up
+// filter's Mode for this frame; it isn't itself stored in the record,
+// since it's already the first two bytes of frame.
+func (w *Writer) Record(dir Direction, peerAddr string, msgType uint16, frame []byte) error {
+	if w.filter.ModeFor(msgType) == ModeHeader && len(frame) > 10 {
+		frame = frame[:10]
+	}
+
+	addr := []byte(peerAddr)
+	header := make([]byte, 8+1+2+len(addr)+4)
+	binary.BigEndian.PutUint64(header[0:8], uint64(time.Since(w.start).Nanoseconds()))
+	header[8] = byte(dir)
+	binary.BigEndian.PutUint16(header[9:11], uint16(len(addr)))
+	copy(header[11:], addr)
+	binary.BigEndian.PutUint32(header[11+len(addr):], uint32(len(frame)))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(frame); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close closes the underlying writer, if it's closeable.
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// Reader reads back the records a Writer produced.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader returns a Reader that reads records from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadRecord reads the next record. It returns io.EOF, unwrapped, only
+// when the stream ends cleanly between records; a file truncated
+// mid-record surfaces io.ErrUnexpectedEOF instead.
+func (r *Reader) ReadRecord() (*Record, error) {
+	fixed := make([]byte, 8+1+2)
+	if _, err := io.ReadFull(r.r, fixed); err != nil {
+		return nil, err
+	}
+	ts := int64(binary.BigEndian.Uint64(fixed[0:8]))
+	dir := Direction(fixed[8])
+	addrLen := binary.BigEndian.Uint16(fixed[9:11])
+
+	addr := make([]byte, addrLen)
+	if addrLen > 0 {
+		if _, err := io.ReadFull(r.r, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	var frameLenBuf [4]byte
+	if _, err := io.ReadFull(r.r, frameLenBuf[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(frameLenBuf[:]))
+	if len(frame) > 0 {
+		if _, err := io.ReadFull(r.r, frame); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Record{
+		Timestamp: time.Duration(ts),
+		Direction: dir,
+		PeerAddr:  string(addr),
+		Frame:     frame,
+	}, nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package binlog
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil)
+
+	frames := []struct {
+		dir      Direction
+		peerAddr string
+		msgType  uint16
+		frame    []byte
+	}{
+		{Sent, "127.0.0.1:5084", 1027, []byte{0x04, 0x03, 0, 0, 0, 10, 0, 0, 0, 1}},
+		{Received, "10.0.0.1:12345", 1037, []byte{0x04, 0x0d, 0, 0, 0, 14, 0, 0, 0, 2, 0xde, 0xad, 0xbe, 0xef}},
+	}
+	for _, f := range frames {
+		if err := w.Record(f.dir, f.peerAddr, f.msgType, f.frame); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	r := NewReader(&buf)
+	for i, want := range frames {
+		rec, err := r.ReadRecord()
+		if err != nil {
+			t.Fatalf("record %d: ReadRecord: %v", i, err)
+		}
+		if rec.Direction != want.dir {
+			t.Errorf("record %d: Direction = %v, want %v", i, rec.Direction, want.dir)
+		}
+		if rec.PeerAddr != want.peerAddr {
+			t.Errorf("record %d: PeerAddr = %q, want %q", i, rec.PeerAddr, want.peerAddr)
+		}
+		if !bytes.Equal(rec.Frame, want.frame) {
+			t.Errorf("record %d: Frame = %x, want %x", i, rec.Frame, want.frame)
+		}
+	}
+
+	if _, err := r.ReadRecord(); err != io.EOF {
+		t.Fatalf("ReadRecord at end = %v, want io.EOF", err)
+	}
+}
+
+func TestWriterModeHeaderTruncatesFrame(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Filter{1037: ModeHeader})
+
+	full := []byte{0x04, 0x0d, 0, 0, 0, 14, 0, 0, 0, 2, 0xde, 0xad, 0xbe, 0xef}
+	if err := w.Record(Sent, "peer", 1037, full); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	// A type with no filter entry still gets ModeFull.
+	if err := w.Record(Sent, "peer", 1027, full); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	r := NewReader(&buf)
+	rec, err := r.ReadRecord()
+	if err != nil {
+		t.Fatalf("ReadRecord: %v", err)
+	}
+	if !bytes.Equal(rec.Frame, full[:10]) {
+		t.Errorf("filtered frame = %x, want header-only %x", rec.Frame, full[:10])
+	}
+
+	rec, err = r.ReadRecord()
+	if err != nil {
+		t.Fatalf("ReadRecord: %v", err)
+	}
+	if !bytes.Equal(rec.Frame, full) {
+		t.Errorf("unfiltered frame = %x, want full %x", rec.Frame, full)
+	}
+}
+
+func TestReadRecordTruncatedMidRecord(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil)
+	if err := w.Record(Sent, "peer", 1027, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-2])
+	r := NewReader(truncated)
+	if _, err := r.ReadRecord(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadRecord on truncated record = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	names := map[string]uint16{"ROAccessReport": 1037, "SetReaderConfig": 1027}
+
+	cases := []struct {
+		name    string
+		spec    string
+		want    Filter
+		wantErr bool
+	}{
+		{name: "empty", spec: "", want: Filter{}},
+		{
+			name: "mixed modes",
+			spec: "ROAccessReport=header,SetReaderConfig=full",
+			want: Filter{1037: ModeHeader, 1027: ModeFull},
+		},
+		{name: "unknown type", spec: "Bogus=header", wantErr: true},
+		{name: "bad mode", spec: "ROAccessReport=sideways", wantErr: true},
+		{name: "missing equals", spec: "ROAccessReport", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseFilter(c.spec, names)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("ParseFilter(%q) = %v, want error", c.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFilter(%q): %v", c.spec, err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("ParseFilter(%q) = %v, want %v", c.spec, got, c.want)
+			}
+			for k, v := range c.want {
+				if got[k] != v {
+					t.Errorf("ParseFilter(%q)[%v] = %v, want %v", c.spec, k, got[k], v)
+				}
+			}
+		})
+	}
+}
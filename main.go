@@ -6,10 +6,10 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -19,6 +19,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -26,28 +27,38 @@ import (
 	"github.com/fatih/structs"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
+	"github.com/hanyangzhao/golemu/internal/binlog"
+	"github.com/hanyangzhao/golemu/internal/logging"
 	"github.com/iomz/go-llrp"
 	"github.com/iomz/go-llrp/binutil"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+// l is the package-level logger, gated per-facet by GOLEMU_TRACE.
+var l = logging.New()
+
 var (
 	// Current Version
 	version = "0.1.0"
 
 	// app
-	app                = kingpin.New("golemu", "A mock LLRP-based logical reader emulator for RFID Tags.")
-	debug              = app.Flag("debug", "Enable debug mode.").Short('v').Default("false").Bool()
-	initialMessageID   = app.Flag("initialMessageID", "The initial messageID to start from.").Default("1000").Int()
-	initialKeepaliveID = app.Flag("initialKeepaliveID", "The initial keepaliveID to start from.").Default("80000").Int()
-	ip                 = app.Flag("ip", "LLRP listening address.").Short('a').Default("0.0.0.0").IP()
-	keepaliveInterval  = app.Flag("keepalive", "LLRP Keepalive interval.").Short('k').Default("0").Int()
-	port               = app.Flag("port", "LLRP listening port.").Short('p').Default("5084").Int()
-	pdu                = app.Flag("pdu", "The maximum size of LLRP PDU.").Short('m').Default("1500").Int()
-	reportInterval     = app.Flag("reportInterval", "The interval of ROAccessReport in ms. Pseudo ROReport spec option.").Short('i').Default("10000").Int()
+	app                      = kingpin.New("golemu", "A mock LLRP-based logical reader emulator for RFID Tags.")
+	debug                    = app.Flag("debug", "Enable debug mode.").Short('v').Default("false").Bool()
+	initialMessageID         = app.Flag("initialMessageID", "The initial messageID to start from.").Default("1000").Int()
+	initialKeepaliveID       = app.Flag("initialKeepaliveID", "The initial keepaliveID to start from.").Default("80000").Int()
+	ip                       = app.Flag("ip", "LLRP listening address.").Short('a').Default("0.0.0.0").IP()
+	port                     = app.Flag("port", "LLRP listening port.").Short('p').Default("5084").Int()
+	pdu                      = app.Flag("pdu", "The maximum size of LLRP PDU.").Short('m').Default("1500").Int()
+	defaultROARInterval      = app.Flag("defaultROARInterval", "The interval of ROAccessReport in ms, used when neither the active ROSpec nor SET_READER_CONFIG specifies a periodic ROReportTrigger.").Short('i').Default("10000").Int()
+	defaultKeepaliveInterval = app.Flag("defaultKeepaliveInterval", "The LLRP keepalive interval in seconds, used when SET_READER_CONFIG doesn't carry a KeepaliveSpec. 0 disables keepalives.").Short('k').Default("0").Int()
+	binlogPath               = app.Flag("binlog", "Path to a binary LLRP message log. In server/client mode, records every frame sent or received; in replay mode, the log to replay.").Default("").String()
+	binlogFilterSpec         = app.Flag("binlogFilter", "Per-message-type recording mode, e.g. \"ROAccessReport=header,SetReaderConfig=full\". Types not listed are recorded in full.").Default("").String()
 
 	// client mode
-	client = app.Command("client", "Run as an LLRP client; connect to an LLRP server and receive events (test-only).")
+	client              = app.Command("client", "Run as an LLRP client; connect to an LLRP server and receive events (test-only).")
+	reconnectBaseDelay  = client.Flag("reconnectBaseDelay", "Base delay before the first reconnect attempt.").Default("1s").Duration()
+	reconnectMaxDelay   = client.Flag("reconnectMaxDelay", "Maximum delay between reconnect attempts.").Default("120s").Duration()
+	reconnectMaxRetries = client.Flag("reconnectMaxRetries", "Maximum number of reconnect attempts before giving up (0 = infinite).").Default("0").Int()
 
 	// server mode
 	server  = app.Command("server", "Run as an LLRP tag stream server.")
@@ -58,9 +69,12 @@ var (
 	simulate      = app.Command("simulate", "Run in the simulator mode.")
 	simulationDir = simulate.Arg("simulationDir", "The directory contains tags for each event cycle.").Required().String()
 
-	// LLRPConn flag
-	isLLRPConnAlive = false
-	// Current messageID
+	// replay mode
+	replay      = app.Command("replay", "Replay a --binlog capture's ROAccessReport frames to a connected LLRP client.")
+	replaySpeed = replay.Flag("speed", "Scale factor for inter-message timing; 2 replays twice as fast, 0.5 half as fast.").Default("1").Float64()
+
+	// Current messageID, used by the client and simulator modes which
+	// only ever talk to a single peer
 	messageID = uint32(*initialMessageID)
 	// Current KeepaliveID
 	keepaliveID = *initialKeepaliveID
@@ -68,10 +82,59 @@ var (
 	tagManagerChannel = make(chan TagManager)
 	// notify tag update channel
 	notify = make(chan bool)
-	// update TagReportDataStack when tag is updated
-	tagUpdated = make(chan llrp.Tags)
+	// sessionRegistry tracks every connected LLRP reader session, fanning
+	// tag updates out to each of them independently
+	sessionRegistry = NewSessionRegistry()
+	// binlogWriter records every LLRP frame Channel reads or writes, set
+	// from --binlog in main() before runServer/runClient starts. nil
+	// disables recording.
+	binlogWriter *binlog.Writer
 )
 
+// binlogMessageTypes maps the message type names accepted by
+// --binlogFilter to their wire header values.
+var binlogMessageTypes = map[string]uint16{
+	"GetReaderCapabilities":         llrp.GetReaderCapabilityHeader,
+	"GetReaderCapabilitiesResponse": llrp.GetReaderCapabilityResponseHeader,
+	"SetReaderConfig":               llrp.SetReaderConfigHeader,
+	"SetReaderConfigResponse":       llrp.SetReaderConfigResponseHeader,
+	"AddROSpec":                     llrp.AddRospecHeader,
+	"AddROSpecResponse":             llrp.AddRospecResponseHeader,
+	"EnableROSpec":                  llrp.EnableRospecHeader,
+	"EnableROSpecResponse":          llrp.EnableRospecResponseHeader,
+	"StartROSpec":                   uint16(startRospecHeader),
+	"StartROSpecResponse":           uint16(startRospecResponseHeader),
+	"StopROSpec":                    uint16(stopRospecHeader),
+	"StopROSpecResponse":            uint16(stopRospecResponseHeader),
+	"DisableROSpec":                 uint16(disableRospecHeader),
+	"DisableROSpecResponse":         uint16(disableRospecResponseHeader),
+	"DeleteROSpec":                  llrp.DeleteRospecHeader,
+	"DeleteROSpecResponse":          llrp.DeleteRospecResponseHeader,
+	"GetROSpecs":                    uint16(getRospecsHeader),
+	"GetROSpecsResponse":            uint16(getRospecsResponseHeader),
+	"Keepalive":                     llrp.KeepaliveHeader,
+	"KeepaliveAck":                  llrp.KeepaliveAckHeader,
+	"ReaderEventNotification":       llrp.ReaderEventNotificationHeader,
+	"ROAccessReport":                llrp.ROAccessReportHeader,
+}
+
+// openBinlog opens path for recording, applying the --binlogFilter spec.
+// An empty path disables recording and returns a nil Writer.
+func openBinlog(path, filterSpec string) (*binlog.Writer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	filter, err := binlog.ParseFilter(filterSpec, binlogMessageTypes)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return binlog.NewWriter(f, filter), nil
+}
+
 // TagManager is a struct for tag management channel
 type TagManager struct {
 	Action ManagementAction
@@ -112,6 +175,12 @@ func APIDeleteTag(c *gin.Context) {
 	}
 }
 
+// APIGetConnections returns the LLRP reader clients currently connected
+// to the server, so operators can see the sessionRegistry fan-out working.
+func APIGetConnections(c *gin.Context) {
+	c.JSON(http.StatusOK, sessionRegistry.Snapshot())
+}
+
 // ReqAddTag handles a tag addition request
 func ReqAddTag(ut string, req []llrp.TagRecord) string {
 	// TODO: success/fail notification per tag
@@ -122,7 +191,7 @@ func ReqAddTag(ut string, req []llrp.TagRecord) string {
 			EPC:    t.EPC,
 		})
 		if err != nil {
-			log.Fatal(err)
+			l.Fatal(err)
 		}
 
 		add := TagManager{
@@ -133,10 +202,10 @@ func ReqAddTag(ut string, req []llrp.TagRecord) string {
 	}
 
 	if failed {
-		log.Printf("failed %v %v", ut, req)
+		l.Debugf(logging.TagMgr, "failed %v %v", ut, req)
 		return "error"
 	}
-	log.Printf("%v %v", ut, req)
+	l.Debugf(logging.TagMgr, "%v %v", ut, req)
 	return ut
 }
 
@@ -160,10 +229,10 @@ func ReqDeleteTag(ut string, req []llrp.TagRecord) string {
 		tagManagerChannel <- delete
 	}
 	if failed {
-		log.Printf("failed %v %v", ut, req)
+		l.Debugf(logging.TagMgr, "failed %v %v", ut, req)
 		return "error"
 	}
-	log.Printf("%v %v", ut, req)
+	l.Debugf(logging.TagMgr, "%v %v", ut, req)
 	return ut
 }
 
@@ -180,135 +249,308 @@ func ReqRetrieveTag() []map[string]interface{} {
 		t := structs.Map(llrp.NewTagRecord(*tag))
 		tagList = append(tagList, t)
 	}
-	log.Printf("retrieve: %v", tagList)
+	l.Debugf(logging.TagMgr, "retrieve: %v", tagList)
 	return tagList
 }
 
-// Handles incoming requests.
-func handleRequest(conn net.Conn, tags llrp.Tags) {
-	// Make a buffer to hold incoming data.
-	buf := make([]byte, *pdu)
+// fatalUnlessDone logs err fatally unless ctx has already been canceled, in
+// which case err is the expected side effect of a listener or connection
+// being closed during shutdown and is reported at info level instead. It
+// returns true when the caller should stop what it's doing.
+func fatalUnlessDone(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if ctx.Err() != nil {
+		l.Infoln("shutting down:", err)
+		return true
+	}
+	l.Fatal(err)
+	return true
+}
+
+// sendROAccessReport frames and writes one RO_ACCESS_REPORT per entry in
+// trds, advancing the session's messageID and reportsSent counters as it
+// goes. It stops at the first write error so a dead connection doesn't
+// spin through the remaining reports. llrp.ROAccessReport doesn't expose
+// its framed bytes, so the frame is still built by hand here, but the
+// actual send goes through ch.WriteMessage like every other site, which
+// gets ctx-aware cancellation and binlog recording for free instead of
+// this function maintaining its own copies of both.
+func (s *ReaderSession) sendROAccessReport(ctx context.Context, ch *Channel, trds llrp.TagReportDataStack) error {
+	for _, trd := range trds {
+		frame := make([]byte, 10+len(trd.Data))
+		binary.BigEndian.PutUint16(frame[0:2], llrp.ROAccessReportHeader)
+		binary.BigEndian.PutUint32(frame[2:6], uint32(len(frame)))
+		binary.BigEndian.PutUint32(frame[6:10], s.messageID)
+		copy(frame[10:], trd.Data)
+		if err := ch.WriteMessage(ctx, frame); err != nil {
+			return ctxErr(ctx, err)
+		}
+		s.messageID++
+		atomic.AddUint64(&s.reportsSent, 1)
+	}
+	return nil
+}
+
+// handleRequest serves s's connection until the client disconnects or ctx
+// is canceled for a graceful shutdown. s is expected to already be
+// registered with sessionRegistry, so tag updates and its report count
+// are visible to every other connected session and to the API, and it
+// owns its own messageID rather than racing other sessions on a package
+// global.
+func (s *ReaderSession) handleRequest(ctx context.Context, tags llrp.Tags) {
+	ch := NewChannel(s.conn)
 	trds := tags.BuildTagReportDataStack(*pdu)
 
+	// thresholdSent latches once the N-tags trigger has fired so that
+	// later tag updates which still sit at or above N don't re-send the
+	// same report on every single change; it clears when the count drops
+	// back below N, ready to fire again on the next crossing.
+	thresholdSent := false
+
 	for {
-		// Read the incoming connection into the buffer.
-		reqLen, err := conn.Read(buf)
+		// Read the next LLRP frame, reassembling it across TCP reads.
+		msg, err := ch.ReadMessage(ctx)
 		if err == io.EOF {
 			// Close the connection when you're done with it.
-			log.Println("the client is disconnected, closing LLRP connection")
-			conn.Close()
+			l.Infoln("the client is disconnected, closing LLRP connection")
+			s.conn.Close()
 			return
 		} else if err != nil {
-			log.Println("closing LLRP connection")
-			log.Print(err)
-			conn.Close()
+			if ctx.Err() != nil {
+				l.Infoln("LLRP connection closed for shutdown")
+			} else {
+				l.Warnln("closing LLRP connection")
+				l.Warn(err)
+			}
+			s.conn.Close()
 			return
 		}
 
 		// Respond according to the LLRP packet header
-		header := binary.BigEndian.Uint16(buf[:2])
-		if header == llrp.SetReaderConfigHeader || header == llrp.KeepaliveAckHeader {
-			if header == llrp.SetReaderConfigHeader {
+		switch msg.Type {
+		case llrp.SetReaderConfigHeader, llrp.KeepaliveAckHeader:
+			if msg.Type == llrp.SetReaderConfigHeader {
 				// SRC received, start ROAR
-				log.Println(">>> SET_READER_CONFIG")
-				conn.Write(llrp.SetReaderConfigResponse())
-				log.Println("<<< SET_READER_CONFIG_RESPONSE")
-			} else if header == llrp.KeepaliveAckHeader {
+				l.Debugln(logging.LLRP, ">>> SET_READER_CONFIG")
+				// Only apply what the client actually specified, so a
+				// SET_READER_CONFIG that omits ROReportSpec/KeepaliveSpec
+				// (e.g. a later reconfiguration touching only antennas)
+				// doesn't reset an earlier one back to the CLI defaults.
+				if roar, keepalive := parseSetReaderConfig(msg.Payload); roar.trigger != 0 || keepalive != 0 {
+					if roar.trigger != 0 {
+						s.rospecs.SetDefaultReportSpec(roar.trigger, roar.n)
+					}
+					if keepalive != 0 {
+						s.keepaliveOverride = keepalive
+					}
+				}
+				ch.WriteMessage(ctx, llrp.SetReaderConfigResponse(s.messageID))
+				s.messageID++
+				l.Debugln(logging.LLRP, "<<< SET_READER_CONFIG_RESPONSE")
+			} else {
 				// KA receieved, continue ROAR
-				log.Println(">>> KEEP_ALIVE_ACK")
+				l.Debugln(logging.Keepalive, ">>> KEEP_ALIVE_ACK")
 			}
 
-			// Tick ROAR and Keepalive interval
-			roarTicker := time.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+			// Tick ROAR and Keepalive interval. The ROAR period comes from
+			// whichever ROSpec is Active, falling back to the reader's
+			// SET_READER_CONFIG default and then --defaultROARInterval; it
+			// stays disabled here (see TickerInterval) when the active
+			// ROReportTrigger is the N-tags mode instead.
+			//
+			// roarTicker is local to this goroutine rather than reassigned
+			// on a shared outer variable, so an earlier cycle's goroutine
+			// (still winding down via the isAlive check below) keeps
+			// selecting on its own ticker instead of this new one. It's
+			// published on s so START_ROSPEC can still reset whichever
+			// ticker is current without that race.
+			roarTicker := time.NewTicker(s.rospecs.TickerInterval(time.Duration(*defaultROARInterval) * time.Millisecond))
+			s.setROARTicker(roarTicker)
+			keepaliveDur := time.Duration(*defaultKeepaliveInterval) * time.Second
+			if s.keepaliveOverride != 0 {
+				keepaliveDur = s.keepaliveOverride
+			}
 			keepaliveTicker := &time.Ticker{}
-			if *keepaliveInterval != 0 {
-				keepaliveTicker = time.NewTicker(time.Duration(*keepaliveInterval) * time.Second)
+			if keepaliveDur != 0 {
+				keepaliveTicker = time.NewTicker(keepaliveDur)
 			}
 			go func() {
 				for { // Infinite loop
-					isLLRPConnAlive = true
+					s.setAlive(true)
 					select {
 					// ROAccessReport interval tick
 					case <-roarTicker.C:
-						log.Printf("<<< RO_ACCESS_REPORT (# reports: %v, # total tags: %v)", len(trds), trds.TotalTagCounts())
-						for _, trd := range trds {
-							roar := llrp.NewROAccessReport(trd.Data, messageID)
-							err := roar.Send(conn)
-							messageID++
-							if err != nil {
-								log.Print(err)
-								isLLRPConnAlive = false
-								break
-							}
+						if !s.rospecs.AnyActive() {
+							continue
+						}
+						l.Debugf(logging.ROAR, "<<< RO_ACCESS_REPORT (# reports: %v, # total tags: %v)", len(trds), trds.TotalTagCounts())
+						if err := s.sendROAccessReport(ctx, ch, trds); err != nil {
+							l.Warn(err)
+							s.setAlive(false)
 						}
 					// Keepalive interval tick
 					case <-keepaliveTicker.C:
-						log.Println("<<< KEEP_ALIVE")
-						conn.Write(llrp.Keepalive())
-						isLLRPConnAlive = false
+						l.Debugln(logging.Keepalive, "<<< KEEP_ALIVE")
+						ch.WriteMessage(ctx, llrp.Keepalive(s.messageID))
+						s.messageID++
+						s.setAlive(false)
 					// When the tag queue is updated
-					case tags := <-tagUpdated:
-						log.Println("### TagUpdated")
+					case tags := <-s.tagUpdated:
+						l.Debugln(logging.TagMgr, "### TagUpdated")
 						trds = tags.BuildTagReportDataStack(*pdu)
+						if n, ok := s.rospecs.ActiveTagThreshold(); ok && trds.TotalTagCounts() >= uint(n) {
+							if !thresholdSent {
+								thresholdSent = true
+								l.Debugf(logging.ROAR, "<<< RO_ACCESS_REPORT (tag threshold reached: %v/%v)", trds.TotalTagCounts(), n)
+								if err := s.sendROAccessReport(ctx, ch, trds); err != nil {
+									l.Warn(err)
+									s.setAlive(false)
+								}
+							}
+						} else {
+							thresholdSent = false
+						}
+					// Shutting down: flush what we have and close up
+					case <-ctx.Done():
+						l.Debugf(logging.ROAR, "<<< RO_ACCESS_REPORT (flushing on shutdown, # reports: %v)", len(trds))
+						s.sendROAccessReport(context.Background(), ch, trds)
+						roarTicker.Stop()
+						if keepaliveDur != 0 {
+							keepaliveTicker.Stop()
+						}
+						s.conn.Close()
+						return
 					}
-					if !isLLRPConnAlive {
+					if !s.isAlive() {
 						roarTicker.Stop()
-						if *keepaliveInterval != 0 {
+						if keepaliveDur != 0 {
 							keepaliveTicker.Stop()
 						}
 						break
 					}
 				}
 			}()
-		} else {
+
+		case llrp.GetReaderCapabilityHeader:
+			l.Debugln(logging.LLRP, ">>> GET_READER_CAPABILITIES")
+			ch.WriteMessage(ctx, llrp.GetReaderCapabilityResponse(s.messageID))
+			l.Debugln(logging.LLRP, "<<< GET_READER_CAPABILITIES_RESPONSE")
+			s.messageID++
+
+		case llrp.AddRospecHeader:
+			l.Debugln(logging.LLRP, ">>> ADD_ROSPEC")
+			id, raw, err := parseROSpec(msg.Payload)
+			if err != nil {
+				ch.WriteMessage(ctx, roSpecStatusResponse(llrp.AddRospecResponseHeader, s.messageID, llrpStatus(statusMParameterError, err.Error()), nil))
+			} else if err := s.rospecs.Add(id, raw); err != nil {
+				ch.WriteMessage(ctx, roSpecStatusResponse(llrp.AddRospecResponseHeader, s.messageID, llrpStatus(statusMFieldError, err.Error()), nil))
+			} else {
+				ch.WriteMessage(ctx, roSpecStatusResponse(llrp.AddRospecResponseHeader, s.messageID, llrpStatus(statusMSuccess, ""), nil))
+			}
+			l.Debugln(logging.LLRP, "<<< ADD_ROSPEC_RESPONSE")
+			s.messageID++
+
+		case llrp.EnableRospecHeader, startRospecHeader, llrp.DeleteRospecHeader, stopRospecHeader, disableRospecHeader:
+			var name string
+			var responseHeader uint16
+			var transition func(uint32) error
+			switch msg.Type {
+			case llrp.EnableRospecHeader:
+				name, responseHeader, transition = "ENABLE_ROSPEC", llrp.EnableRospecResponseHeader, s.rospecs.Enable
+			case startRospecHeader:
+				name, responseHeader, transition = "START_ROSPEC", startRospecResponseHeader, s.rospecs.Start
+			case llrp.DeleteRospecHeader:
+				name, responseHeader, transition = "DELETE_ROSPEC", llrp.DeleteRospecResponseHeader, s.rospecs.Delete
+			case stopRospecHeader:
+				name, responseHeader, transition = "STOP_ROSPEC", stopRospecResponseHeader, s.rospecs.Stop
+			case disableRospecHeader:
+				name, responseHeader, transition = "DISABLE_ROSPEC", disableRospecResponseHeader, s.rospecs.Disable
+			}
+			if len(msg.Payload) < 4 {
+				l.Debugf(logging.LLRP, ">>> %v (truncated)", name)
+				ch.WriteMessage(ctx, roSpecStatusResponse(responseHeader, s.messageID, llrpStatus(statusMParameterError, errShortROSpecMessage.Error()), nil))
+				l.Debugf(logging.LLRP, "<<< %v_RESPONSE", name)
+				s.messageID++
+				break
+			}
+			id := binary.BigEndian.Uint32(msg.Payload[0:4])
+			l.Debugf(logging.LLRP, ">>> %v (ROSpecID: %v)", name, id)
+			if err := transition(id); err != nil {
+				ch.WriteMessage(ctx, roSpecStatusResponse(responseHeader, s.messageID, llrpStatus(statusMFieldError, err.Error()), nil))
+			} else {
+				ch.WriteMessage(ctx, roSpecStatusResponse(responseHeader, s.messageID, llrpStatus(statusMSuccess, ""), nil))
+				if msg.Type == startRospecHeader {
+					s.resetROARTicker(s.rospecs.TickerInterval(time.Duration(*defaultROARInterval) * time.Millisecond))
+				}
+			}
+			l.Debugf(logging.LLRP, "<<< %v_RESPONSE", name)
+			s.messageID++
+
+		case getRospecsHeader:
+			l.Debugln(logging.LLRP, ">>> GET_ROSPECS")
+			body := []byte{}
+			for _, raw := range s.rospecs.All() {
+				body = append(body, raw...)
+			}
+			ch.WriteMessage(ctx, roSpecStatusResponse(getRospecsResponseHeader, s.messageID, llrpStatus(statusMSuccess, ""), body))
+			l.Debugln(logging.LLRP, "<<< GET_ROSPECS_RESPONSE")
+			s.messageID++
+
+		default:
 			// Unknown LLRP packet received, reset the connection
-			log.Printf("unknown header: %v, reqlen: %v", header, reqLen)
-			log.Printf("message: %v", buf)
+			l.Warnf("unknown header: %v, payload len: %v", msg.Type, len(msg.Payload))
+			l.Debugf(logging.LLRP, "payload: %v", msg.Payload)
 			return
 		}
 	}
 }
 
 // server mode
-func runServer() int {
+func runServer(ctx context.Context) int {
 	// Read virtual tags from a csv file
-	log.Printf("loading virtual Tags from \"%v\"", *file)
+	l.Infof("loading virtual Tags from \"%v\"", *file)
 
 	var tags llrp.Tags
 	if _, err := os.Stat(*file); os.IsNotExist(err) {
-		log.Printf("%v doesn't exist, couldn't load tags", *file)
+		l.Warnf("%v doesn't exist, couldn't load tags", *file)
 	} else {
 		err := binutil.Load(*file, &tags)
 		if err != nil {
-			log.Fatal(err)
+			l.Fatal(err)
 		}
-		log.Printf("%v tags loaded from %v", len(tags), *file)
+		l.Infof("%v tags loaded from %v", len(tags), *file)
 	}
 
 	// Listen for incoming connections.
-	l, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(*port))
+	ln, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(*port))
 	if err != nil {
 		panic(err)
 	}
+	l.Infof("listening on %v:%v", ip, *port)
 
-	// Close the listener when the application closes.
-	defer l.Close()
-	log.Printf("listening on %v:%v", ip, *port)
-
-	// Channel for communicating virtual tag updates and signals
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var wg sync.WaitGroup
 
 	// Handle /tags
+	apiSrv := &http.Server{Addr: ":" + strconv.Itoa(*apiPort)}
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		r := gin.Default()
 		v1 := r.Group("api/v1")
 		v1.POST("/tags", APIPostTag)
 		v1.DELETE("/tags", APIDeleteTag)
-		r.Run(":" + strconv.Itoa(*apiPort))
+		v1.GET("/connections", APIGetConnections)
+		apiSrv.Handler = r
+		if err := apiSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			l.Warnf("API server error: %v", err)
+		}
 	}()
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
 			case cmd := <-tagManagerChannel:
@@ -322,9 +564,8 @@ func runServer() int {
 							res = append(res, t)
 							// Write to file
 							//writeTagsToCSV(*tags, *file)
-							if isLLRPConnAlive {
-								tagUpdated <- tags
-							}
+							l.Debugf(logging.TagMgr, "added %v, %v tags total", t, len(tags))
+							sessionRegistry.Broadcast(tags)
 						}
 					}
 				case DeleteTags:
@@ -334,9 +575,8 @@ func runServer() int {
 							res = append(res, t)
 							// Write to file
 							//writeTagsToCSV(tags, *file)
-							if isLLRPConnAlive {
-								tagUpdated <- tags
-							}
+							l.Debugf(logging.TagMgr, "deleted %v, %v tags total", t, len(tags))
+							sessionRegistry.Broadcast(tags)
 						}
 					}
 				case RetrieveTags:
@@ -344,103 +584,246 @@ func runServer() int {
 				}
 				cmd.Tags = res
 				tagManagerChannel <- cmd
-			case signal := <-signals:
-				// Handle SIGINT and SIGTERM.
-				log.Fatalf("%v", signal)
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
+	// Unblock Accept and drain the API server once the root context is
+	// canceled. Each handleRequest goroutine watches ctx itself to flush
+	// and close its own connection.
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := apiSrv.Shutdown(shutdownCtx); err != nil {
+			l.Warnf("API server shutdown: %v", err)
+		}
+	}()
+
 	// Handle LLRP connection
-	log.Println("starting LLRP connection...")
+	l.Infoln("starting LLRP connection...")
 	for {
 		// Accept an incoming connection.
-		conn, err := l.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			log.Fatal(err)
+			fatalUnlessDone(ctx, err)
+			break
 		}
-		log.Println("LLRP connection initiated")
+		l.Debugln(logging.LLRP, "LLRP connection initiated")
+
+		// Register first so the READER_EVENT_NOTIFICATION below is sent on
+		// session's own messageID sequence rather than the unrelated
+		// package-global counter, which left the first ID a client ever
+		// sees discontinuous with the very next one (the session's own
+		// first generated ID).
+		session := sessionRegistry.Register(conn)
 
 		// Send back READER_EVENT_NOTIFICATION
 		currentTime := uint64(time.Now().UTC().Nanosecond() / 1000)
-		conn.Write(llrp.ReaderEventNotification(messageID, currentTime))
-		log.Println("<<< READER_EVENT_NOTIFICATION")
-		atomic.AddUint32(&messageID, 1)
+		NewChannel(conn).WriteMessage(ctx, llrp.ReaderEventNotification(session.messageID, currentTime))
+		l.Debugln(logging.LLRP, "<<< READER_EVENT_NOTIFICATION")
+		session.messageID++
 		runtime.Gosched()
 		time.Sleep(time.Millisecond)
 
 		// Handle connections in a new goroutine.
-		go handleRequest(conn, tags)
+		wg.Add(1)
+		go func(session *ReaderSession) {
+			defer wg.Done()
+			defer sessionRegistry.Deregister(session.conn)
+			session.handleRequest(ctx, tags)
+		}(session)
 	}
+
+	wg.Wait()
+	l.Infoln("server shut down cleanly")
+	return 0
 }
 
-// client mode
-func runClient() int {
-	// Establish a connection to the llrp client
-	// sleep for 5 seconds if the host is not available and retry
-	log.Printf("waiting for %s:%d ...", ip.String(), *port)
-	conn, err := net.Dial("tcp", ip.String()+":"+strconv.Itoa(*port))
-	for err != nil {
-		time.Sleep(time.Second)
-		conn, err = net.Dial("tcp", ip.String()+":"+strconv.Itoa(*port))
-	}
-	log.Printf("establised an LLRP connection with %v", conn.RemoteAddr())
-
-	header := make([]byte, 2)
-	length := make([]byte, 4)
-	messageID := make([]byte, 4)
+// runClientSession drives one connected client session until it errors or
+// ctx is canceled. It resets *retries to 0 on the first successful
+// SET_READER_CONFIG_RESPONSE, so a connection that ran fine for a while
+// before dropping doesn't inherit a stale, large backoff delay.
+func runClientSession(ctx context.Context, conn net.Conn, retries *int) {
+	defer conn.Close()
+	ch := NewChannel(conn)
 	for {
-		_, err = io.ReadFull(conn, header)
+		msg, err := ch.ReadMessage(ctx)
 		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = io.ReadFull(conn, length)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = io.ReadFull(conn, messageID)
-		if err != nil {
-			log.Fatal(err)
-		}
-		// length containts the size of the entire message in octets
-		// starting from bit offset 0, hence, the message size is
-		// length - 10 bytes
-		var messageValue []byte
-		if messageSize := binary.BigEndian.Uint32(length) - 10; messageSize != 0 {
-			messageValue = make([]byte, binary.BigEndian.Uint32(length)-10)
-			_, err = io.ReadFull(conn, messageValue)
-			if err != nil {
-				log.Fatal(err)
+			if ctx.Err() == nil {
+				l.Warnln("LLRP connection lost:", err)
 			}
+			return
 		}
 
-		h := binary.BigEndian.Uint16(header)
-		mid := binary.BigEndian.Uint32(messageID)
-		switch h {
+		switch msg.Type {
 		case llrp.ReaderEventNotificationHeader:
-			log.Printf(">>> READER_EVENT_NOTIFICATION [Message ID: %d]", mid)
-			conn.Write(llrp.SetReaderConfig(mid + 1))
+			l.Debugf(logging.LLRP, ">>> READER_EVENT_NOTIFICATION [Message ID: %d]", msg.ID)
+			ch.WriteMessage(ctx, llrp.SetReaderConfig(msg.ID+1))
 		case llrp.KeepaliveHeader:
-			log.Printf(">>> KEEP_ALIVE [Message ID: %d]", mid)
-			conn.Write(llrp.KeepaliveAck())
+			l.Debugf(logging.Keepalive, ">>> KEEP_ALIVE [Message ID: %d]", msg.ID)
+			ch.WriteMessage(ctx, llrp.KeepaliveAck(msg.ID))
 		case llrp.SetReaderConfigResponseHeader:
-			log.Printf(">>> SET_READER_CONFIG_RESPONSE [Message ID: %d]", mid)
+			l.Debugf(logging.LLRP, ">>> SET_READER_CONFIG_RESPONSE [Message ID: %d]", msg.ID)
+			*retries = 0
 		case llrp.ROAccessReportHeader:
-			log.Printf(">>> RO_ACCESS_REPORT [Message ID: %d]", mid)
-			res := llrp.UnmarshalROAccessReportBody(messageValue)
-			log.Printf("%v events received", len(res))
+			l.Debugf(logging.ROAR, ">>> RO_ACCESS_REPORT [Message ID: %d]", msg.ID)
+			res := llrp.UnmarshalROAccessReportBody(msg.Payload)
+			l.Debugf(logging.ROAR, "%v events received", len(res))
 		default:
-			log.Fatalf("Unknown header: %v, Message ID: %d", h, mid)
+			l.Fatalf("Unknown header: %v, Message ID: %d", msg.Type, msg.ID)
 		}
 	}
 }
 
+// client mode
+func runClient(ctx context.Context) int {
+	backoff := ExponentialBackoff{
+		BaseDelay:  *reconnectBaseDelay,
+		Multiplier: 1.6,
+		MaxDelay:   *reconnectMaxDelay,
+	}
+	retries := 0
+	for {
+		l.Infof("waiting for %s:%d ...", ip.String(), *port)
+		conn, err := net.Dial("tcp", ip.String()+":"+strconv.Itoa(*port))
+		if err != nil {
+			if *reconnectMaxRetries > 0 && retries >= *reconnectMaxRetries {
+				l.Fatalf("giving up after %d reconnect attempts: %v", retries, err)
+			}
+			delay := backoff.Backoff(retries)
+			retries++
+			l.Warnf("connect to %s:%d failed (attempt %d), retrying in %v: %v", ip, *port, retries, delay, err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return 0
+			}
+		}
+
+		l.Infof("establised an LLRP connection with %v", conn.RemoteAddr())
+		runClientSession(ctx, conn, &retries)
+		if ctx.Err() != nil {
+			return 0
+		}
+
+		// The session ended without ctx being canceled, e.g. the server
+		// accepted and then hung up before SET_READER_CONFIG_RESPONSE.
+		// Back off the same as a failed dial so this doesn't busy-loop
+		// redialing with no delay.
+		if *reconnectMaxRetries > 0 && retries >= *reconnectMaxRetries {
+			l.Fatalf("giving up after %d reconnect attempts", retries)
+		}
+		delay := backoff.Backoff(retries)
+		retries++
+		l.Warnf("LLRP session ended (attempt %d), retrying in %v", retries, delay)
+		select {
+		case <-time.After(delay):
+			continue
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
+
+// replay mode
+func runReplay(ctx context.Context) int {
+	if *replaySpeed <= 0 {
+		l.Fatalf("--speed must be greater than 0, got %v", *replaySpeed)
+	}
+
+	f, err := os.Open(*binlogPath)
+	if err != nil {
+		l.Fatal(err)
+	}
+	defer f.Close()
+
+	reader := binlog.NewReader(f)
+	var records []*binlog.Record
+	skipped := 0
+	for {
+		rec, err := reader.ReadRecord()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			l.Fatal(err)
+		}
+		if len(rec.Frame) < 10 || binary.BigEndian.Uint16(rec.Frame[0:2]) != llrp.ROAccessReportHeader {
+			continue
+		}
+		if len(rec.Frame) == 10 {
+			// Recorded with --binlogFilter ROAccessReport=header: no tag
+			// data survived to replay.
+			skipped++
+			continue
+		}
+		records = append(records, rec)
+	}
+	l.Infof("loaded %v RO_ACCESS_REPORT frames from %v", len(records), *binlogPath)
+	if skipped > 0 {
+		l.Warnf("skipped %v RO_ACCESS_REPORT frames recorded header-only (no tag data to replay)", skipped)
+	}
+
+	ln, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(*port))
+	if err != nil {
+		l.Fatal(err)
+	}
+	defer ln.Close()
+	l.Infof("listening on %v:%v", ip, *port)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	conn, err := ln.Accept()
+	if fatalUnlessDone(ctx, err) {
+		return 0
+	}
+	defer conn.Close()
+	l.Infof("established an LLRP connection with %v", conn.RemoteAddr())
+	ch := NewChannel(conn)
+
+	currentTime := uint64(time.Now().UTC().Nanosecond() / 1000)
+	ch.WriteMessage(ctx, llrp.ReaderEventNotification(uint32(*initialMessageID), currentTime))
+
+	// Pace by the gaps between consecutive ROAccessReport frames, not by
+	// their absolute captured timestamps, so replay starts emitting as
+	// soon as a client connects instead of replaying the idle time that
+	// preceded the first ROAccessReport in the original capture.
+	var last time.Duration
+	for i, rec := range records {
+		var wait time.Duration
+		if i > 0 {
+			wait = rec.Timestamp - last
+		}
+		last = rec.Timestamp
+		wait = time.Duration(float64(wait) / *replaySpeed)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0
+		}
+		if err := ch.WriteMessage(ctx, rec.Frame); err != nil {
+			l.Warnln("replay stopped early:", err)
+			return 0
+		}
+		l.Debugf(logging.ROAR, "<<< RO_ACCESS_REPORT (%v/%v)", i+1, len(records))
+	}
+	l.Infoln("replay finished")
+	return 0
+}
+
 func loadTagsForNextEventCycle(simulationFiles []string, eventCycle *int) (llrp.Tags, error) {
 	tags := llrp.Tags{}
 	if len(simulationFiles) <= *eventCycle {
 		//log.Printf("Total iteration: %v, current event cycle: %v", len(simulationFiles), eventCycle)
 		//return tags, fmt.Errorf("no more event cycle found in %s", *simulationDir)
-		log.Printf("Resetting event cycle from %v to 0", *eventCycle)
+		l.Debugf(logging.Sim, "Resetting event cycle from %v to 0", *eventCycle)
 		*eventCycle = 0
 	}
 	err := binutil.Load(simulationFiles[*eventCycle], &tags)
@@ -451,15 +834,15 @@ func loadTagsForNextEventCycle(simulationFiles []string, eventCycle *int) (llrp.
 }
 
 // simulator mode
-func runSimulation() {
+func runSimulation(ctx context.Context) int {
 	// read simulation dir and prepare the file list
 	dir, err := filepath.Abs(*simulationDir)
 	if err != nil {
-		log.Fatal(err)
+		l.Fatal(err)
 	}
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatal(err)
+		l.Fatal(err)
 	}
 	simulationFiles := []string{}
 	for _, f := range files {
@@ -468,41 +851,47 @@ func runSimulation() {
 		}
 	}
 	if len(simulationFiles) == 0 {
-		log.Fatalf("no event cycle file found in %s", *simulationDir)
+		l.Fatalf("no event cycle file found in %s", *simulationDir)
 	}
 
 	// start listening for incoming connections.
-	l, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(*port))
+	ln, err := net.Listen("tcp", ip.String()+":"+strconv.Itoa(*port))
 	if err != nil {
 		panic(err)
 	}
-	defer l.Close()
-	log.Printf("listening on %v:%v", ip, *port)
 
-	// channel for communicating virtual tag updates and signals
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		for {
-			select {
-			case signal := <-signals:
-				log.Fatal(signal)
-			}
-		}
+		defer wg.Done()
+		<-ctx.Done()
+		ln.Close()
 	}()
+	l.Infof("listening on %v:%v", ip, *port)
 
 	// handle LLRP connection
-	log.Println("waiting for LLRP connection...")
-	conn, err := l.Accept()
+	l.Infoln("waiting for LLRP connection...")
+	conn, err := ln.Accept()
 	if err != nil {
-		log.Fatal(err)
+		if fatalUnlessDone(ctx, err) {
+			wg.Wait()
+			return 0
+		}
 	}
-	log.Printf("initiated LLRP connection with %v", conn.RemoteAddr())
+	ch := NewChannel(conn)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		conn.Close()
+	}()
+	l.Debugf(logging.Sim, "initiated LLRP connection with %v", conn.RemoteAddr())
 
 	// Send back READER_EVENT_NOTIFICATION
 	currentTime := uint64(time.Now().UTC().Nanosecond() / 1000)
-	conn.Write(llrp.ReaderEventNotification(messageID, currentTime))
-	log.Println("<<< READER_EVENT_NOTIFICATION")
+	ch.WriteMessage(ctx, llrp.ReaderEventNotification(messageID, currentTime))
+	l.Debugln(logging.LLRP, "<<< READER_EVENT_NOTIFICATION")
 	messageID++
 
 	// simulate event cycles from 0
@@ -511,54 +900,45 @@ func runSimulation() {
 	// initialize the first event cycle and roarTicker
 	tags, err := loadTagsForNextEventCycle(simulationFiles, &eventCycle)
 	if err != nil {
-		log.Fatal(err)
+		l.Fatal(err)
 	}
 	eventCycle++
 	trds := tags.BuildTagReportDataStack(*pdu)
-	roarTicker := time.NewTicker(time.Duration(*reportInterval) * time.Millisecond)
+	roarTicker := time.NewTicker(time.Duration(*defaultROARInterval) * time.Millisecond)
 
-	// prepare LLRP header storage
-	header := make([]byte, 2)
-	length := make([]byte, 4)
-	receivedMessageID := make([]byte, 4)
 	for {
-		_, err = io.ReadFull(conn, header)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = io.ReadFull(conn, length)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = io.ReadFull(conn, receivedMessageID)
+		msg, err := ch.ReadMessage(ctx)
 		if err != nil {
-			log.Fatal(err)
-		}
-		var messageValue []byte
-		if messageSize := binary.BigEndian.Uint32(length) - 10; messageSize != 0 {
-			messageValue = make([]byte, binary.BigEndian.Uint32(length)-10)
-			_, err = io.ReadFull(conn, messageValue)
-			if err != nil {
-				log.Fatal(err)
+			if fatalUnlessDone(ctx, err) {
+				break
 			}
+			continue
 		}
 
-		h := binary.BigEndian.Uint16(header)
-		switch h {
+		switch msg.Type {
 		case llrp.SetReaderConfigHeader:
-			conn.Write(llrp.SetReaderConfigResponse())
+			ch.WriteMessage(ctx, llrp.SetReaderConfigResponse(messageID))
+			messageID++
+			wg.Add(1)
 			go func() {
+				defer wg.Done()
 				for {
-					_, ok := <-roarTicker.C
-					if !ok {
-						log.Fatalln("roarTicker died")
+					select {
+					case <-ctx.Done():
+						roarTicker.Stop()
+						return
+					case _, ok := <-roarTicker.C:
+						if !ok {
+							l.Fatalln("roarTicker died")
+						}
 					}
-					log.Printf("<<< Simulated Event Cycle %v, %v tags, %v roars", eventCycle, len(tags), len(trds))
+					l.Debugf(logging.Sim, "<<< Simulated Event Cycle %v, %v tags, %v roars", eventCycle, len(tags), len(trds))
 					for _, trd := range trds {
 						roar := llrp.NewROAccessReport(trd.Data, messageID)
 						err := roar.Send(conn)
 						if err != nil {
-							log.Fatal(err)
+							l.Warn(err)
+							break
 						}
 						messageID++
 					}
@@ -566,7 +946,7 @@ func runSimulation() {
 					tags, err = loadTagsForNextEventCycle(simulationFiles, &eventCycle)
 					eventCycle++
 					if err != nil {
-						log.Print(err)
+						l.Warn(err)
 						continue
 					}
 					trds = tags.BuildTagReportDataStack(*pdu)
@@ -574,9 +954,12 @@ func runSimulation() {
 			}()
 		default:
 			// unknown LLRP packet received, reset the connection
-			log.Printf(">>> header: %v", h)
+			l.Warnf(">>> header: %v", msg.Type)
 		}
 	}
+
+	wg.Wait()
+	return 0
 }
 
 func main() {
@@ -591,12 +974,45 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// Cancel the root context on SIGINT/SIGTERM so servers can drain
+	// in-flight connections instead of dying mid-report. A second signal
+	// falls through to the default Go behavior (immediate termination).
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		l.Infof("received %v, shutting down gracefully (send again to force)", sig)
+		cancel()
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	}()
+
+	// --binlog records frames in server/client mode; replay mode reads it
+	// directly from *binlogPath instead, so it's opened just for those two.
+	if parse == server.FullCommand() || parse == client.FullCommand() {
+		w, err := openBinlog(*binlogPath, *binlogFilterSpec)
+		if err != nil {
+			l.Fatal(err)
+		}
+		binlogWriter = w
+	}
+
+	var code int
 	switch parse {
 	case server.FullCommand():
-		os.Exit(runServer())
+		code = runServer(ctx)
 	case client.FullCommand():
-		os.Exit(runClient())
+		code = runClient(ctx)
 	case simulate.FullCommand():
-		runSimulation()
+		code = runSimulation(ctx)
+	case replay.FullCommand():
+		code = runReplay(ctx)
+	}
+
+	if binlogWriter != nil {
+		if err := binlogWriter.Close(); err != nil {
+			l.Warnln("binlog: close failed:", err)
+		}
 	}
+	os.Exit(code)
 }
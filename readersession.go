@@ -0,0 +1,147 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iomz/go-llrp"
+)
+
+// ReaderSession is the per-connection state tracked by SessionRegistry.
+// Each LLRP reader session owns its own messageID counter, keepalive
+// state, ROSpec configuration and tagUpdated subscription, so that
+// concurrent readers no longer race on package globals.
+type ReaderSession struct {
+	conn        net.Conn
+	tagUpdated  chan llrp.Tags
+	alive       int32 // atomic bool, 1 while the session's ROAR/keepalive loop is running
+	connectedAt time.Time
+	messageID   uint32
+	reportsSent uint64
+	rospecs     *ROSpecManager
+	// keepaliveOverride is the KeepaliveSpec.PeriodicTriggerValue the
+	// client set via SET_READER_CONFIG; 0 means it never sent one, so
+	// handleRequest falls back to --defaultKeepaliveInterval.
+	keepaliveOverride time.Duration
+	// roarMu guards roarTicker. handleRequest (re)creates the ticker as a
+	// goroutine-local value on every SET_READER_CONFIG/KEEPALIVE_ACK, but
+	// publishes it here so a later START_ROSPEC can reset the period of
+	// whichever ticker is currently running instead of racing its own,
+	// possibly stale, closure over the variable.
+	roarMu     sync.Mutex
+	roarTicker *time.Ticker
+}
+
+// setROARTicker records t as s's current ROAR ticker.
+func (s *ReaderSession) setROARTicker(t *time.Ticker) {
+	s.roarMu.Lock()
+	s.roarTicker = t
+	s.roarMu.Unlock()
+}
+
+// resetROARTicker resets s's current ROAR ticker to d, if one has been
+// created yet.
+func (s *ReaderSession) resetROARTicker(d time.Duration) {
+	s.roarMu.Lock()
+	defer s.roarMu.Unlock()
+	if s.roarTicker != nil {
+		s.roarTicker.Reset(d)
+	}
+}
+
+// isAlive reports whether the session's report loop is currently running.
+func (s *ReaderSession) isAlive() bool {
+	return atomic.LoadInt32(&s.alive) != 0
+}
+
+// setAlive updates the session's running state.
+func (s *ReaderSession) setAlive(alive bool) {
+	v := int32(0)
+	if alive {
+		v = 1
+	}
+	atomic.StoreInt32(&s.alive, v)
+}
+
+// ConnectionInfo is the JSON snapshot of a connected reader exposed via
+// GET /api/v1/connections.
+type ConnectionInfo struct {
+	RemoteAddr  string `json:"remoteAddr"`
+	Uptime      string `json:"uptime"`
+	ReportsSent uint64 `json:"reportsSent"`
+}
+
+// SessionRegistry tracks every active ReaderSession so that tag updates
+// can be fanned out to each of them independently. Before this, a single
+// package-global tagUpdated channel and isLLRPConnAlive flag meant a
+// second Accept'ed connection would race with the first.
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*ReaderSession
+}
+
+// NewSessionRegistry returns an empty SessionRegistry.
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*ReaderSession)}
+}
+
+// Register starts tracking conn and returns its ReaderSession.
+func (r *SessionRegistry) Register(conn net.Conn) *ReaderSession {
+	s := &ReaderSession{
+		conn:        conn,
+		tagUpdated:  make(chan llrp.Tags, 1),
+		connectedAt: time.Now(),
+		messageID:   uint32(*initialMessageID),
+		rospecs:     NewROSpecManager(),
+	}
+	r.mu.Lock()
+	r.sessions[conn.RemoteAddr().String()] = s
+	r.mu.Unlock()
+	return s
+}
+
+// Deregister stops tracking conn.
+func (r *SessionRegistry) Deregister(conn net.Conn) {
+	r.mu.Lock()
+	delete(r.sessions, conn.RemoteAddr().String())
+	r.mu.Unlock()
+}
+
+// Broadcast fans tags out to every registered, alive session. A session
+// that hasn't drained its previous update yet is skipped rather than
+// blocking the tag-manager goroutine.
+func (r *SessionRegistry) Broadcast(tags llrp.Tags) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if !s.isAlive() {
+			continue
+		}
+		select {
+		case s.tagUpdated <- tags:
+		default:
+		}
+	}
+}
+
+// Snapshot returns the currently connected readers for the API.
+func (r *SessionRegistry) Snapshot() []ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]ConnectionInfo, 0, len(r.sessions))
+	for addr, s := range r.sessions {
+		infos = append(infos, ConnectionInfo{
+			RemoteAddr:  addr,
+			Uptime:      time.Since(s.connectedAt).String(),
+			ReportsSent: atomic.LoadUint64(&s.reportsSent),
+		})
+	}
+	return infos
+}
@@ -0,0 +1,415 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iomz/go-llrp"
+)
+
+// The vendored go-llrp library only defines ADD_ROSPEC, DELETE_ROSPEC and
+// ENABLE_ROSPEC, and its Status() parameter always reports M_Success. The
+// rest of the ROSpec state machine (START/STOP/DISABLE/GET_ROSPECS and
+// arbitrary LLRPStatus codes) is added here rather than in the library,
+// since go-llrp is a third-party dependency we don't own.
+const (
+	startRospecHeader   = 1046 // type 22
+	stopRospecHeader    = 1047 // type 23
+	disableRospecHeader = 1049 // type 25
+	getRospecsHeader    = 1050 // type 26
+
+	startRospecResponseHeader   = 1056 // type 32
+	stopRospecResponseHeader    = 1057 // type 33
+	disableRospecResponseHeader = 1059 // type 35
+	getRospecsResponseHeader    = 1060 // type 36
+)
+
+// LLRPStatus codes used when rejecting a ROSpec command. M_Success is
+// already defined implicitly by llrp.Status(), which we can't reuse here
+// since it doesn't let us report failure.
+const (
+	statusMSuccess        = uint16(0)
+	statusMParameterError = uint16(100)
+	statusMFieldError     = uint16(101)
+)
+
+// ROSpec parameter/sub-parameter types, from the LLRP spec.
+const (
+	roSpecParamType        = 177
+	roReportSpecParamType  = 237
+	keepaliveSpecParamType = 220
+)
+
+// ROReportTrigger values this emulator derives a report policy from; every
+// other trigger value falls back to the reader's default interval.
+const (
+	roReportTriggerNTags    = 1 // Upon_N_Tags_Or_End_Of_ROSpec
+	roReportTriggerPeriodic = 2 // Upon_N_Seconds_Or_End_Of_ROSpec
+)
+
+// keepaliveTriggerPeriodic is the KeepaliveSpec trigger value meaning
+// "send a keepalive every TimeInterval milliseconds".
+const keepaliveTriggerPeriodic = 1
+
+// llrpStatus packs an LLRPStatus parameter (type 287) carrying code and an
+// optional human-readable description. It's the failure-capable sibling of
+// llrp.Status(), which always hardcodes M_Success.
+func llrpStatus(code uint16, desc string) []byte {
+	descBytes := []byte(desc)
+	data := []interface{}{
+		uint16(287),                // Rsvd+Type=287 (LLRPStatus)
+		uint16(8 + len(descBytes)), // Length
+		code,                       // StatusCode
+		uint16(len(descBytes)),     // ErrorDescriptionByteCount
+	}
+	if len(descBytes) > 0 {
+		data = append(data, descBytes)
+	}
+	return llrp.Pack(data)
+}
+
+// roSpecStatusResponse builds one of the *_ROSPEC_RESPONSE messages the
+// library doesn't provide (START/STOP/DISABLE/GET_ROSPECS), all of which
+// share the same "header + LLRPStatus [+ ROSpecs]" shape.
+func roSpecStatusResponse(header uint16, messageID uint32, status []byte, body []byte) []byte {
+	length := uint32(10 + len(status) + len(body))
+	data := []interface{}{
+		uint16(header),
+		length,
+		messageID,
+		status,
+	}
+	if len(body) > 0 {
+		data = append(data, body)
+	}
+	return llrp.Pack(data)
+}
+
+// ROSpecState mirrors the three states a ROSpec moves through per the
+// LLRP spec: Disabled (just added), Inactive (enabled, not reporting) and
+// Active (started, reporting tags).
+type ROSpecState uint8
+
+const (
+	ROSpecDisabled ROSpecState = iota
+	ROSpecInactive
+	ROSpecActive
+)
+
+func (s ROSpecState) String() string {
+	switch s {
+	case ROSpecDisabled:
+		return "Disabled"
+	case ROSpecInactive:
+		return "Inactive"
+	case ROSpecActive:
+		return "Active"
+	default:
+		return "Unknown"
+	}
+}
+
+// rospec is the server's bookkeeping for one client-submitted ROSpec. raw
+// holds the original ROSpec parameter bytes exactly as ADD_ROSPEC sent
+// them; the CurrentState byte within it is kept in sync with state so
+// GET_ROSPECS_RESPONSE can just replay raw back to the client.
+type rospec struct {
+	state ROSpecState
+	raw   []byte
+	roar  roarSpec // from this ROSpec's own ROReportSpec, zero if absent
+}
+
+// roarSpec is a ROReportTrigger and its N parameter, read either from a
+// ROSpec's own ROReportSpec or from the reader-wide default a client sets
+// via SET_READER_CONFIG.
+type roarSpec struct {
+	trigger byte
+	n       uint16
+}
+
+// interval reports the wall-clock period roar implies, or def if roar
+// isn't using the periodic trigger.
+func (roar roarSpec) interval(def time.Duration) time.Duration {
+	if roar.trigger == roReportTriggerPeriodic && roar.n > 0 {
+		return time.Duration(roar.n) * time.Second
+	}
+	return def
+}
+
+// tagThreshold reports the tag count roar's N-tags trigger requires before
+// flushing a report, and whether roar is actually using that trigger.
+func (roar roarSpec) tagThreshold() (n uint16, ok bool) {
+	return roar.n, roar.trigger == roReportTriggerNTags && roar.n > 0
+}
+
+var errUnknownROSpec = errors.New("ROSpecID not found")
+
+// errShortROSpecMessage is reported when a ROSpec command arrives
+// truncated (e.g. split across TCP reads), so handleRequest can reject it
+// with a proper LLRPStatus instead of panicking or reading stale bytes out
+// of the reusable read buffer.
+var errShortROSpecMessage = errors.New("message too short to contain a ROSpecID")
+
+// ROSpecManager tracks one LLRP session's ROSpecs and enforces the
+// ADD/ENABLE/START/STOP/DISABLE/DELETE state machine, instead of the
+// server starting ROAccessReports the instant a client connects.
+type ROSpecManager struct {
+	mu          sync.Mutex
+	specs       map[uint32]*rospec
+	order       []uint32
+	defaultROAR roarSpec // the reader-wide default from SET_READER_CONFIG, zero if the client never sent one
+}
+
+// NewROSpecManager returns an empty ROSpecManager.
+func NewROSpecManager() *ROSpecManager {
+	return &ROSpecManager{specs: make(map[uint32]*rospec)}
+}
+
+// Add registers a new ROSpec in the Disabled state, as ADD_ROSPEC requires.
+func (m *ROSpecManager) Add(id uint32, raw []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.specs[id]; exists {
+		return fmt.Errorf("ROSpecID %d already exists", id)
+	}
+	m.specs[id] = &rospec{
+		state: ROSpecDisabled,
+		raw:   raw,
+		roar:  parseROReportSpec(raw, 10),
+	}
+	m.order = append(m.order, id)
+	return nil
+}
+
+// transition moves id to to, failing if it isn't currently in one of from
+// (an empty from allows any current state, as DISABLE_ROSPEC does).
+func (m *ROSpecManager) transition(id uint32, from []ROSpecState, to ROSpecState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rs, ok := m.specs[id]
+	if !ok {
+		return errUnknownROSpec
+	}
+	allowed := len(from) == 0
+	for _, f := range from {
+		if rs.state == f {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("ROSpecID %d is %v, cannot transition to %v", id, rs.state, to)
+	}
+	rs.state = to
+	if len(rs.raw) > 9 {
+		rs.raw[9] = byte(to)
+	}
+	return nil
+}
+
+// Enable moves a Disabled ROSpec to Inactive.
+func (m *ROSpecManager) Enable(id uint32) error {
+	return m.transition(id, []ROSpecState{ROSpecDisabled}, ROSpecInactive)
+}
+
+// Start moves an Inactive ROSpec to Active.
+func (m *ROSpecManager) Start(id uint32) error {
+	return m.transition(id, []ROSpecState{ROSpecInactive}, ROSpecActive)
+}
+
+// Stop moves an Active ROSpec back to Inactive.
+func (m *ROSpecManager) Stop(id uint32) error {
+	return m.transition(id, []ROSpecState{ROSpecActive}, ROSpecInactive)
+}
+
+// Disable moves a ROSpec to Disabled regardless of its current state.
+func (m *ROSpecManager) Disable(id uint32) error {
+	return m.transition(id, nil, ROSpecDisabled)
+}
+
+// Delete removes a ROSpec. An id of 0 means "all ROSpecs", per the spec.
+func (m *ROSpecManager) Delete(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == 0 {
+		m.specs = make(map[uint32]*rospec)
+		m.order = nil
+		return nil
+	}
+	if _, ok := m.specs[id]; !ok {
+		return errUnknownROSpec
+	}
+	delete(m.specs, id)
+	for i, v := range m.order {
+		if v == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// AnyActive reports whether at least one ROSpec is currently Active, i.e.
+// whether the session should be sending ROAccessReports at all.
+func (m *ROSpecManager) AnyActive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rs := range m.specs {
+		if rs.state == ROSpecActive {
+			return true
+		}
+	}
+	return false
+}
+
+// activeROAR returns the first Active ROSpec's own ROReportSpec, or the
+// reader-wide default set via SET_READER_CONFIG when it didn't carry one.
+// The zero roarSpec is returned when no ROSpec is Active.
+func (m *ROSpecManager) activeROAR() roarSpec {
+	for _, rs := range m.specs {
+		if rs.state == ROSpecActive {
+			if rs.roar.trigger != 0 {
+				return rs.roar
+			}
+			return m.defaultROAR
+		}
+	}
+	return roarSpec{}
+}
+
+// ActiveInterval returns the ROReportSpec-derived interval of the first
+// Active ROSpec found, or def when none is Active, or neither it nor the
+// reader's SET_READER_CONFIG default specified a periodic trigger.
+func (m *ROSpecManager) ActiveInterval(def time.Duration) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeROAR().interval(def)
+}
+
+// ActiveTagThreshold reports the "report every N tags" threshold in force
+// for the first Active ROSpec, preferring its own ROReportSpec over the
+// reader's SET_READER_CONFIG default. ok is false when neither specifies
+// the N-tags trigger, meaning the caller should stick to its wall-clock
+// ticker instead.
+func (m *ROSpecManager) ActiveTagThreshold() (n uint16, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeROAR().tagThreshold()
+}
+
+// roarTickerDisabled is the duration handleRequest resets its wall-clock
+// ROAR ticker to when the active ROReportTrigger uses the N-tags mode
+// instead of a period, since a time.Ticker can't be stopped without
+// losing the ability to Reset it again later (e.g. once the ROSpec stops
+// being Active, or a later ROSpec reintroduces a periodic trigger).
+const roarTickerDisabled = 24 * time.Hour
+
+// TickerInterval returns the duration handleRequest's wall-clock ROAR
+// ticker should run at: roarTickerDisabled when the active ROReportTrigger
+// is using the N-tags mode instead, since sendROAccessReport is then
+// driven by tag count rather than time.
+func (m *ROSpecManager) TickerInterval(def time.Duration) time.Duration {
+	if _, ok := m.ActiveTagThreshold(); ok {
+		return roarTickerDisabled
+	}
+	return m.ActiveInterval(def)
+}
+
+// SetDefaultReportSpec installs the reader-wide ROReportSpec a client set
+// via SET_READER_CONFIG, used by any ROSpec that doesn't carry its own.
+func (m *ROSpecManager) SetDefaultReportSpec(trigger byte, n uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultROAR = roarSpec{trigger: trigger, n: n}
+}
+
+// All returns every stored ROSpec's current raw bytes, in ADD_ROSPEC order,
+// for GET_ROSPECS_RESPONSE.
+func (m *ROSpecManager) All() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([][]byte, 0, len(m.order))
+	for _, id := range m.order {
+		out = append(out, m.specs[id].raw)
+	}
+	return out
+}
+
+// parseROSpec extracts the ROSpecID from an ADD_ROSPEC message payload
+// (everything after the 10-byte LLRP header) and returns it along with the
+// raw ROSpec parameter, unpacked only as far as we need to drive it
+// through the state machine.
+func parseROSpec(payload []byte) (uint32, []byte, error) {
+	if len(payload) < 10 || binary.BigEndian.Uint16(payload[0:2]) != roSpecParamType {
+		return 0, nil, fmt.Errorf("ADD_ROSPEC payload missing ROSpec parameter")
+	}
+	length := binary.BigEndian.Uint16(payload[2:4])
+	if int(length) > len(payload) {
+		return 0, nil, fmt.Errorf("ROSpec parameter length %d exceeds payload", length)
+	}
+	id := binary.BigEndian.Uint32(payload[4:8])
+	return id, payload[:length], nil
+}
+
+// findParam scans a TLV-encoded parameter list's direct children (2-byte
+// Type, 2-byte Length-including-header, then the rest of the parameter)
+// starting at offset, and returns the first child matching want, header
+// included. ok is false if none is found or the list is malformed.
+func findParam(data []byte, offset int, want uint16) (param []byte, ok bool) {
+	for offset+4 <= len(data) {
+		pType := binary.BigEndian.Uint16(data[offset : offset+2])
+		pLen := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		if pLen < 4 || offset+pLen > len(data) {
+			return nil, false
+		}
+		if pType == want {
+			return data[offset : offset+pLen], true
+		}
+		offset += pLen
+	}
+	return nil, false
+}
+
+// parseROReportSpec scans data, starting at offset, for a ROReportSpec
+// parameter and returns its trigger and N. It returns the zero roarSpec if
+// data doesn't carry one, so callers fall back to their own default.
+func parseROReportSpec(data []byte, offset int) roarSpec {
+	param, ok := findParam(data, offset, roReportSpecParamType)
+	if !ok || len(param) < 7 {
+		return roarSpec{}
+	}
+	return roarSpec{trigger: param[4], n: binary.BigEndian.Uint16(param[5:7])}
+}
+
+// parseKeepaliveSpec scans data, starting at offset, for a KeepaliveSpec
+// parameter using the periodic trigger and returns the corresponding
+// interval. It returns 0 if data doesn't carry one, or its trigger isn't
+// periodic, so callers fall back to their own default.
+func parseKeepaliveSpec(data []byte, offset int) time.Duration {
+	param, ok := findParam(data, offset, keepaliveSpecParamType)
+	if !ok || len(param) < 9 || param[4] != keepaliveTriggerPeriodic {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(param[5:9])) * time.Millisecond
+}
+
+// parseSetReaderConfig extracts the reader-wide ROReportSpec and
+// KeepaliveSpec parameters directly from a SET_READER_CONFIG payload
+// (everything after the 10-byte LLRP header), as opposed to
+// parseROReportSpec's other caller, which reads one nested inside a
+// per-ROSpec ADD_ROSPEC payload. Either may be absent if the client relies
+// on the reader's compiled-in defaults instead.
+func parseSetReaderConfig(payload []byte) (roar roarSpec, keepalive time.Duration) {
+	// Skip the 1-byte Reserved(7)+ResetToFactoryDefault(1) field that
+	// precedes SET_READER_CONFIG's parameters.
+	const paramsOffset = 1
+	return parseROReportSpec(payload, paramsOffset), parseKeepaliveSpec(payload, paramsOffset)
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2018 Iori Mizutani
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// newTestROSpec builds the minimal 10-byte ROSpec fixed header (id,
+// priority, state) that ROSpecManager needs; none of these tests exercise
+// the ROReportSpec sub-parameter ADD_ROSPEC may carry after it.
+func newTestROSpec(id uint32) []byte {
+	raw := make([]byte, 10)
+	binary.BigEndian.PutUint32(raw[4:8], id)
+	return raw
+}
+
+func TestROSpecManagerTransitions(t *testing.T) {
+	m := NewROSpecManager()
+	if err := m.Add(1, newTestROSpec(1)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := m.Add(1, newTestROSpec(1)); err == nil {
+		t.Fatal("Add on an existing ROSpecID: got nil error, want one")
+	}
+
+	// Start before Enable is rejected: a fresh ROSpec is Disabled, not Inactive.
+	if err := m.Start(1); err == nil {
+		t.Fatal("Start on a Disabled ROSpec: got nil error, want one")
+	}
+
+	if err := m.Enable(1); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	if m.AnyActive() {
+		t.Fatal("AnyActive after Enable (still Inactive) = true, want false")
+	}
+
+	if err := m.Start(1); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if !m.AnyActive() {
+		t.Fatal("AnyActive after Start = false, want true")
+	}
+
+	if err := m.Stop(1); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if m.AnyActive() {
+		t.Fatal("AnyActive after Stop = true, want false")
+	}
+
+	// Disable works from any state, including Inactive (where Stop left it).
+	if err := m.Disable(1); err != nil {
+		t.Fatalf("Disable: %v", err)
+	}
+	if err := m.Start(1); err == nil {
+		t.Fatal("Start on a Disabled ROSpec: got nil error, want one")
+	}
+
+	if err := m.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := m.Delete(1); err != errUnknownROSpec {
+		t.Fatalf("Delete on an already-deleted ROSpecID = %v, want errUnknownROSpec", err)
+	}
+}
+
+func TestROSpecManagerDeleteAll(t *testing.T) {
+	m := NewROSpecManager()
+	for _, id := range []uint32{1, 2, 3} {
+		if err := m.Add(id, newTestROSpec(id)); err != nil {
+			t.Fatalf("Add(%d): %v", id, err)
+		}
+	}
+	if err := m.Delete(0); err != nil {
+		t.Fatalf("Delete(0): %v", err)
+	}
+	if len(m.All()) != 0 {
+		t.Fatalf("All() after Delete(0) = %v, want empty", m.All())
+	}
+}
+
+func TestROSpecManagerUnknownID(t *testing.T) {
+	m := NewROSpecManager()
+	for _, err := range []error{m.Enable(99), m.Start(99), m.Stop(99), m.Disable(99)} {
+		if err != errUnknownROSpec {
+			t.Errorf("transition on unknown ROSpecID = %v, want errUnknownROSpec", err)
+		}
+	}
+}
+
+func TestTickerIntervalNTagsModeDisablesTicker(t *testing.T) {
+	m := NewROSpecManager()
+	m.SetDefaultReportSpec(roReportTriggerNTags, 5)
+	if err := m.Add(1, newTestROSpec(1)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := m.Enable(1); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	if err := m.Start(1); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if got := m.TickerInterval(10 * time.Second); got != roarTickerDisabled {
+		t.Fatalf("TickerInterval in N-tags mode = %v, want roarTickerDisabled (%v)", got, roarTickerDisabled)
+	}
+	if n, ok := m.ActiveTagThreshold(); !ok || n != 5 {
+		t.Fatalf("ActiveTagThreshold = (%v, %v), want (5, true)", n, ok)
+	}
+}
+
+func TestTickerIntervalPeriodicMode(t *testing.T) {
+	m := NewROSpecManager()
+	m.SetDefaultReportSpec(roReportTriggerPeriodic, 7)
+	if err := m.Add(1, newTestROSpec(1)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := m.Enable(1); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	if err := m.Start(1); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	want := 7 * time.Second
+	if got := m.TickerInterval(10 * time.Second); got != want {
+		t.Fatalf("TickerInterval in periodic mode = %v, want %v", got, want)
+	}
+	if _, ok := m.ActiveTagThreshold(); ok {
+		t.Fatal("ActiveTagThreshold in periodic mode: ok = true, want false")
+	}
+}
+
+func TestTickerIntervalFallsBackWhenNoneActive(t *testing.T) {
+	m := NewROSpecManager()
+	def := 3 * time.Second
+	if got := m.TickerInterval(def); got != def {
+		t.Fatalf("TickerInterval with no Active ROSpec = %v, want the default %v", got, def)
+	}
+}